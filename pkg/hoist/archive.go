@@ -0,0 +1,432 @@
+package hoist
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/ulikunitz/xz"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// newXzReader wraps xz.NewReader to match the (io.Reader, error) shape the
+// other decompressors use.
+func newXzReader(r io.Reader) (io.Reader, error) {
+	return xz.NewReader(r)
+}
+
+// Extractor unpacks an archive read from r into dest, chowning the regular
+// files and directory entries it writes to uid:gid. Symlinks are not chowned.
+type Extractor interface {
+	Extract(ctx context.Context, r io.Reader, dest string, uid, gid int) error
+}
+
+// safeJoin joins name onto dest the way filepath.Join(dest, name) would, but
+// rejects names that are absolute or that use ".." to escape dest (a
+// "zip slip"/"tar slip" archive entry). Archives, particularly zip archives,
+// routinely come from less-trusted locations than the rest of this package's
+// inputs, so every entry's path needs this check before it's ever used to
+// open or create a file.
+func safeJoin(dest, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", util.Errorf("Archive entry %q has an absolute path", name)
+	}
+
+	fpath := filepath.Join(dest, name)
+
+	destPrefix := filepath.Clean(dest) + string(os.PathSeparator)
+	if fpath != filepath.Clean(dest) && !strings.HasPrefix(fpath, destPrefix) {
+		return "", util.Errorf("Archive entry %q escapes destination directory %s", name, dest)
+	}
+
+	return fpath, nil
+}
+
+// checkSymlinkTraversal returns an error if any path component strictly
+// between dest and fpath is a symlink. safeJoin only rejects an entry whose
+// own name lexically escapes dest; it can't stop an archive that plants a
+// symlink (e.g. "escape" -> "/") and then ships a later entry like
+// "escape/payload" which lexically stays under dest but the kernel resolves
+// through the symlink to somewhere else entirely. Every entry must be
+// checked against the tree as extracted so far, not just its own name.
+func checkSymlinkTraversal(dest, fpath string) error {
+	rel, err := filepath.Rel(dest, fpath)
+	if err != nil {
+		return err
+	}
+
+	dir := dest
+	for _, part := range strings.Split(filepath.Dir(rel), string(os.PathSeparator)) {
+		if part == "." || part == "" {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+
+		info, err := os.Lstat(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return util.Errorf("Archive entry %q traverses through symlink %s", fpath, dir)
+		}
+	}
+	return nil
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte{0x42, 0x5a, 0x68}
+	xzMagic    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	zipMagic   = []byte{0x50, 0x4b, 0x03, 0x04}
+)
+
+// extractorFor sniffs fp's magic bytes (falling back to its extension) and
+// returns the Extractor that knows how to unpack it. fp's offset is restored
+// to the start of the file before returning.
+func extractorFor(fp *os.File) (Extractor, error) {
+	defer fp.Seek(0, io.SeekStart)
+
+	header := make([]byte, 6)
+	n, err := io.ReadFull(fp, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return &tarExtractor{decompress: func(r io.Reader) (io.Reader, io.Closer, error) {
+			fz, err := gzip.NewReader(r)
+			return fz, fz, err
+		}}, nil
+	case bytes.HasPrefix(header, bzip2Magic):
+		return &tarExtractor{decompress: func(r io.Reader) (io.Reader, io.Closer, error) {
+			return bzip2.NewReader(r), ioutil.NopCloser(nil), nil
+		}}, nil
+	case bytes.HasPrefix(header, xzMagic):
+		return &tarExtractor{decompress: func(r io.Reader) (io.Reader, io.Closer, error) {
+			xr, err := newXzReader(r)
+			return xr, ioutil.NopCloser(nil), err
+		}}, nil
+	case bytes.HasPrefix(header, zipMagic):
+		return &zipExtractor{}, nil
+	}
+
+	switch filepath.Ext(fp.Name()) {
+	case ".zip":
+		return &zipExtractor{}, nil
+	case ".bz2":
+		return &tarExtractor{decompress: func(r io.Reader) (io.Reader, io.Closer, error) {
+			return bzip2.NewReader(r), ioutil.NopCloser(nil), nil
+		}}, nil
+	case ".xz":
+		return &tarExtractor{decompress: func(r io.Reader) (io.Reader, io.Closer, error) {
+			xr, err := newXzReader(r)
+			return xr, ioutil.NopCloser(nil), err
+		}}, nil
+	}
+
+	// neither magic bytes nor extension matched; default to tar.gz
+	return &tarExtractor{decompress: func(r io.Reader) (io.Reader, io.Closer, error) {
+		fz, err := gzip.NewReader(r)
+		return fz, fz, err
+	}}, nil
+}
+
+// tarExtractor unpacks a tar stream, applying decompress to the raw archive
+// bytes first. decompress returns the decompressed reader along with an
+// (optionally no-op) Closer to release any resources it holds.
+type tarExtractor struct {
+	decompress func(io.Reader) (io.Reader, io.Closer, error)
+}
+
+// pendingHardlink records a tar.TypeLink entry seen during pass one so it can
+// be materialized in pass two, once every regular file it might point at has
+// been written to disk.
+type pendingHardlink struct {
+	linkPath   string
+	targetPath string
+}
+
+// pendingDirTimes records a directory's tarball timestamps so they can be
+// applied in a final pass, after everything that might be written inside
+// that directory (including pass two's hardlinks) is done. Applying them
+// any earlier just gets clobbered: creating a file or hardlink inside a
+// directory bumps that directory's mtime right back up.
+type pendingDirTimes struct {
+	path string
+	hdr  *tar.Header
+}
+
+func (e *tarExtractor) Extract(ctx context.Context, r io.Reader, dest string, uid, gid int) error {
+	decompressed, closer, err := e.decompress(r)
+	if err != nil {
+		return util.Errorf("Unable to create decompressor: %s", err)
+	}
+	defer closer.Close()
+
+	tr := tar.NewReader(decompressed)
+
+	var pendingLinks []pendingHardlink
+	var pendingDirs []pendingDirTimes
+
+	// Pass one: write every regular file, directory, and symlink, and
+	// record hardlinks for pass two since their targets may not exist yet.
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return util.Errorf("Unable to read tar archive: %s", err)
+		}
+		fpath, err := safeJoin(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := checkSymlinkTraversal(dest, fpath); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, fpath)
+			if err != nil {
+				return util.Errorf("Unable to create destination symlink %s (to %s): %s", fpath, hdr.Linkname, err)
+			}
+			continue
+		case tar.TypeLink:
+			linkTarget, err := safeJoin(dest, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := checkSymlinkTraversal(dest, linkTarget); err != nil {
+				return err
+			}
+			pendingLinks = append(pendingLinks, pendingHardlink{
+				linkPath:   fpath,
+				targetPath: linkTarget,
+			})
+			continue
+		case tar.TypeDir:
+			err = os.Mkdir(fpath, hdr.FileInfo().Mode())
+			if err != nil && !os.IsExist(err) {
+				return util.Errorf("Unable to create destination directory %s: %s", fpath, err)
+			}
+
+			err = os.Chown(fpath, uid, gid)
+			if err != nil {
+				return util.Errorf("Unable to chown destination directory %s: %s", fpath, err)
+			}
+
+			err = applyXattrs(fpath, hdr)
+			if err != nil {
+				return util.Errorf("Unable to apply xattrs to %s: %s", fpath, err)
+			}
+
+			// defer the timestamp to the final pass; anything written into
+			// this directory later would otherwise bump its mtime back up
+			pendingDirs = append(pendingDirs, pendingDirTimes{path: fpath, hdr: hdr})
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode())
+			if err != nil {
+				return util.Errorf("Unable to open destination file %s: %s", fpath, err)
+			}
+
+			err = f.Chown(uid, gid) // this operation may cause tar unpacking to become significantly slower. Refactor as necessary.
+			if err != nil {
+				f.Close()
+				return util.Errorf("Unable to chown destination file %s: %s", fpath, err)
+			}
+
+			_, err = io.Copy(f, tr)
+			f.Close() // eagerly release file descriptors rather than letting them pile up
+			if err != nil {
+				return util.Errorf("Unable to copy into destination file %s: %s", fpath, err)
+			}
+		default:
+			return util.Errorf("Unhandled type flag %q (header %v)", hdr.Typeflag, hdr)
+		}
+
+		err = applyXattrs(fpath, hdr)
+		if err != nil {
+			return util.Errorf("Unable to apply xattrs to %s: %s", fpath, err)
+		}
+
+		err = os.Chtimes(fpath, hdr.AccessTime, hdr.ModTime)
+		if err != nil {
+			return util.Errorf("Unable to set timestamps on %s: %s", fpath, err)
+		}
+	}
+
+	// Pass two: now that every regular file exists, materialize the
+	// hardlinks we saw along the way.
+	for _, link := range pendingLinks {
+		err := os.Link(link.targetPath, link.linkPath)
+		if err != nil {
+			if !isCrossDeviceLinkError(err) {
+				return util.Errorf("Unable to create hardlink %s (to %s): %s", link.linkPath, link.targetPath, err)
+			}
+
+			// the filesystem rejected a cross-device hardlink (dest spans
+			// multiple mounts); fall back to a symlink in that case.
+			relTarget, relErr := filepath.Rel(filepath.Dir(link.linkPath), link.targetPath)
+			if relErr != nil {
+				return util.Errorf("Unable to create hardlink %s (to %s): %s", link.linkPath, link.targetPath, err)
+			}
+			err = os.Symlink(relTarget, link.linkPath)
+			if err != nil {
+				return util.Errorf("Unable to create hardlink or fallback symlink %s (to %s): %s", link.linkPath, link.targetPath, err)
+			}
+		}
+	}
+
+	// Pass three: apply directory timestamps now that nothing further will
+	// be written underneath them, deepest directories first so that setting
+	// a parent's mtime is never followed by a child directory's own Mkdir
+	// (which would bump the parent's mtime right back up).
+	sort.Slice(pendingDirs, func(i, j int) bool {
+		return strings.Count(pendingDirs[i].path, string(os.PathSeparator)) > strings.Count(pendingDirs[j].path, string(os.PathSeparator))
+	})
+	for _, dir := range pendingDirs {
+		err := os.Chtimes(dir.path, dir.hdr.AccessTime, dir.hdr.ModTime)
+		if err != nil {
+			return util.Errorf("Unable to set timestamps on %s: %s", dir.path, err)
+		}
+	}
+
+	return nil
+}
+
+// isCrossDeviceLinkError reports whether err is the cross-device-link error
+// os.Link returns when the source and destination live on different
+// filesystems (EXDEV), as opposed to any other failure (missing target,
+// permission denied, disk full, ...) that happens to share the same
+// *os.LinkError type.
+func isCrossDeviceLinkError(err error) bool {
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) {
+		return false
+	}
+	return errors.Is(linkErr.Err, syscall.EXDEV)
+}
+
+// zipExtractor unpacks a zip archive. archive/zip requires an io.ReaderAt, so
+// Extract only accepts *os.File (or anything else with ReadAt and Stat
+// methods) rather than an arbitrary io.Reader.
+type zipExtractor struct{}
+
+func (e *zipExtractor) Extract(ctx context.Context, r io.Reader, dest string, uid, gid int) error {
+	ra, ok := r.(interface {
+		io.ReaderAt
+		Stat() (os.FileInfo, error)
+	})
+	if !ok {
+		return util.Errorf("zip extraction requires a seekable file, got %T", r)
+	}
+
+	info, err := ra.Stat()
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(ra, info.Size())
+	if err != nil {
+		return util.Errorf("Unable to create zip reader: %s", err)
+	}
+
+	for _, zf := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fpath, err := safeJoin(dest, zf.Name)
+		if err != nil {
+			return err
+		}
+		if err := checkSymlinkTraversal(dest, fpath); err != nil {
+			return err
+		}
+
+		if zf.FileInfo().IsDir() {
+			err = os.MkdirAll(fpath, zf.Mode())
+			if err != nil {
+				return util.Errorf("Unable to create destination directory %s: %s", fpath, err)
+			}
+			err = os.Chown(fpath, uid, gid)
+			if err != nil {
+				return util.Errorf("Unable to chown destination directory %s: %s", fpath, err)
+			}
+			continue
+		}
+
+		if zf.Mode()&os.ModeSymlink != 0 {
+			src, err := zf.Open()
+			if err != nil {
+				return util.Errorf("Unable to open zip entry %s: %s", zf.Name, err)
+			}
+			linkTarget, err := ioutil.ReadAll(src)
+			src.Close()
+			if err != nil {
+				return util.Errorf("Unable to read symlink target for zip entry %s: %s", zf.Name, err)
+			}
+
+			err = os.Symlink(string(linkTarget), fpath)
+			if err != nil {
+				return util.Errorf("Unable to create destination symlink %s (to %s): %s", fpath, linkTarget, err)
+			}
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(fpath), 0755)
+		if err != nil {
+			return util.Errorf("Unable to create parent directory for %s: %s", fpath, err)
+		}
+
+		src, err := zf.Open()
+		if err != nil {
+			return util.Errorf("Unable to open zip entry %s: %s", zf.Name, err)
+		}
+
+		f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, zf.Mode())
+		if err != nil {
+			src.Close()
+			return util.Errorf("Unable to open destination file %s: %s", fpath, err)
+		}
+
+		_, err = io.Copy(f, src)
+		src.Close()
+		if err != nil {
+			f.Close()
+			return util.Errorf("Unable to copy into destination file %s: %s", fpath, err)
+		}
+
+		err = f.Chown(uid, gid)
+		f.Close()
+		if err != nil {
+			return util.Errorf("Unable to chown destination file %s: %s", fpath, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package hoist
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     []byte
+}
+
+func buildTarGz(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("writing tar header for %s: %s", e.name, err)
+		}
+		if len(e.body) > 0 {
+			if _, err := tw.Write(e.body); err != nil {
+				t.Fatalf("writing tar body for %s: %s", e.name, err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("closing gzip writer: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+func newTarExtractor() *tarExtractor {
+	return &tarExtractor{decompress: func(r io.Reader) (io.Reader, io.Closer, error) {
+		fz, err := gzip.NewReader(r)
+		return fz, fz, err
+	}}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "archive-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	return dir
+}
+
+func TestTarExtractRejectsDotDotEscape(t *testing.T) {
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+
+	data := buildTarGz(t, []tarEntry{
+		{name: "../escape", typeflag: tar.TypeReg, body: []byte("pwned")},
+	})
+
+	err := newTarExtractor().Extract(context.Background(), bytes.NewReader(data), dest, os.Getuid(), os.Getgid())
+	if err == nil {
+		t.Fatalf("expected an error rejecting the escaping entry, got nil")
+	}
+}
+
+func TestTarExtractRejectsSymlinkTraversal(t *testing.T) {
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+
+	data := buildTarGz(t, []tarEntry{
+		{name: "escape", typeflag: tar.TypeSymlink, linkname: "/"},
+		{name: "escape/payload", typeflag: tar.TypeReg, body: []byte("pwned")},
+	})
+
+	err := newTarExtractor().Extract(context.Background(), bytes.NewReader(data), dest, os.Getuid(), os.Getgid())
+	if err == nil {
+		t.Fatalf("expected an error rejecting traversal through the planted symlink, got nil")
+	}
+}
+
+type zipEntry struct {
+	name string
+	mode os.FileMode
+	body []byte
+}
+
+func buildZip(t *testing.T, entries []zipEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		fh.SetMode(e.mode)
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("creating zip entry %s: %s", e.name, err)
+		}
+		if _, err := w.Write(e.body); err != nil {
+			t.Fatalf("writing zip entry %s: %s", e.name, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing zip writer: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+func writeTempZip(t *testing.T, data []byte) *os.File {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "archive-test-*.zip")
+	if err != nil {
+		t.Fatalf("creating temp zip file: %s", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("writing temp zip file: %s", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seeking temp zip file: %s", err)
+	}
+
+	return f
+}
+
+func TestZipExtractRejectsDotDotEscape(t *testing.T) {
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+
+	data := buildZip(t, []zipEntry{
+		{name: "../escape", mode: 0644, body: []byte("pwned")},
+	})
+	f := writeTempZip(t, data)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err := (&zipExtractor{}).Extract(context.Background(), f, dest, os.Getuid(), os.Getgid())
+	if err == nil {
+		t.Fatalf("expected an error rejecting the escaping entry, got nil")
+	}
+}
+
+func TestZipExtractRestoresSymlinks(t *testing.T) {
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+
+	data := buildZip(t, []zipEntry{
+		{name: "link", mode: os.ModeSymlink | 0777, body: []byte("target")},
+	})
+	f := writeTempZip(t, data)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err := (&zipExtractor{}).Extract(context.Background(), f, dest, os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Fatalf("extracting zip: %s", err)
+	}
+
+	target, err := os.Readlink(filepath.Join(dest, "link"))
+	if err != nil {
+		t.Fatalf("reading back symlink: %s", err)
+	}
+	if target != "target" {
+		t.Fatalf("expected symlink target %q, got %q", "target", target)
+	}
+}
+
+func TestTarExtractHardlinkRoundTrip(t *testing.T) {
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+
+	data := buildTarGz(t, []tarEntry{
+		{name: "original", typeflag: tar.TypeReg, body: []byte("shared content")},
+		{name: "linked", typeflag: tar.TypeLink, linkname: "original"},
+	})
+
+	err := newTarExtractor().Extract(context.Background(), bytes.NewReader(data), dest, os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Fatalf("extracting tar: %s", err)
+	}
+
+	origInfo, err := os.Stat(filepath.Join(dest, "original"))
+	if err != nil {
+		t.Fatalf("stat original: %s", err)
+	}
+	linkInfo, err := os.Stat(filepath.Join(dest, "linked"))
+	if err != nil {
+		t.Fatalf("stat linked: %s", err)
+	}
+	if !os.SameFile(origInfo, linkInfo) {
+		t.Fatalf("expected linked to be a hardlink to original")
+	}
+}
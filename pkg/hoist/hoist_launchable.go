@@ -1,15 +1,17 @@
 package hoist
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
 
 	"github.com/square/p2/pkg/artifact"
 	"github.com/square/p2/pkg/cgroups"
@@ -19,35 +21,64 @@ import (
 	"github.com/square/p2/pkg/util"
 )
 
-type Fetcher func(string, string) error
+// Fetcher downloads the artifact at src to dst, aborting if ctx is cancelled
+// or its deadline expires.
+type Fetcher func(ctx context.Context, src, dst string) error
 
 // A HoistLaunchable represents a particular install of a hoist artifact.
 type Launchable struct {
-	Location     string         // A URL where we can download the artifact from.
-	Id           string         // A unique identifier for this launchable, used when creating runit services
-	RunAs        string         // The user to assume when launching the executable
-	ConfigDir    string         // The value for chpst -e. See http://smarden.org/runit/chpst.8.html
-	FetchToFile  Fetcher        // Callback that downloads the file from the remote location.
-	RootDir      string         // The root directory of the launchable, containing N:N>=1 installs.
-	Chpst        string         // The path to chpst
-	Cgexec       string         // The path to cgexec
-	CgroupConfig cgroups.Config // Cgroup parameters to use with cgexec
+	Location       string         // A URL where we can download the artifact from.
+	Id             string         // A unique identifier for this launchable, used when creating runit services
+	RunAs          string         // The user to assume when launching the executable
+	ConfigDir      string         // The value for chpst -e. See http://smarden.org/runit/chpst.8.html
+	FetchToFile    Fetcher        // Callback that downloads the file from the remote location.
+	RootDir        string         // The root directory of the launchable, containing N:N>=1 installs.
+	Chpst          string         // The path to chpst
+	Cgexec         string         // The path to cgexec
+	CgroupConfig   cgroups.Config // Cgroup parameters to use with cgexec
+	InstallTimeout time.Duration  // Upper bound on fetch+extract during Install, zero means no timeout
+	HookTimeout    time.Duration  // Upper bound on a single bin/ script invocation, zero means no timeout
+
+	ExpectedSHA256    string             // Hex-encoded SHA256 the downloaded artifact must match. Empty skips the check.
+	SignatureLocation string             // A URL where the detached signature for the artifact can be downloaded from. Empty skips signature verification.
+	Keyring           openpgp.EntityList // Keys trusted to sign artifacts, used to verify SignatureLocation
+
+	Retention RetentionPolicy // If set, Install prunes old installs under this policy once it succeeds
 }
 
 func DefaultFetcher() Fetcher {
-	return uri.URICopy
+	return func(ctx context.Context, srcPath, dstPath string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// uri.URICopy takes no context: when ctx is done this returns
+		// ctx.Err() right away, but the copy itself keeps running in the
+		// background until it finishes on its own.
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- uri.URICopy(srcPath, dstPath)
+		}()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errCh:
+			return err
+		}
+	}
 }
 
-func (hl *Launchable) Halt(serviceBuilder *runit.ServiceBuilder, sv *runit.SV) error {
+func (hl *Launchable) Halt(ctx context.Context, serviceBuilder *runit.ServiceBuilder, sv *runit.SV) error {
 
 	// probably want to do something with output at some point
-	_, err := hl.Disable()
+	_, err := hl.Disable(ctx, hl.InstallDir())
 	if err != nil {
 		return err
 	}
 
 	// probably want to do something with output at some point
-	err = hl.Stop(serviceBuilder, sv)
+	err = hl.Stop(ctx, serviceBuilder, sv, hl.InstallDir())
 	if err != nil {
 		return err
 	}
@@ -60,7 +91,7 @@ func (hl *Launchable) Halt(serviceBuilder *runit.ServiceBuilder, sv *runit.SV) e
 	return nil
 }
 
-func (hl *Launchable) Launch(serviceBuilder *runit.ServiceBuilder, sv *runit.SV) error {
+func (hl *Launchable) Launch(ctx context.Context, serviceBuilder *runit.ServiceBuilder, sv *runit.SV) error {
 	err := cgroups.Default.Write(hl.CgroupConfig)
 	if err != nil {
 		return util.Errorf("Could not configure cgroup %s: %s", hl.CgroupConfig.Name, err)
@@ -68,17 +99,17 @@ func (hl *Launchable) Launch(serviceBuilder *runit.ServiceBuilder, sv *runit.SV)
 
 	// Should probably do something with output at some point
 	// probably want to do something with output at some point
-	err = hl.Start(serviceBuilder, sv)
+	err = hl.Start(ctx, serviceBuilder, sv, hl.InstallDir())
 	if err != nil {
 		return util.Errorf("Could not launch %s: %s", hl.Id, err)
 	}
 
-	_, err = hl.Enable()
+	_, err = hl.Enable(ctx, hl.InstallDir())
 	return err
 }
 
-func (hl *Launchable) PostActivate() (string, error) {
-	output, err := hl.invokeBinScript("post-activate")
+func (hl *Launchable) PostActivate(ctx context.Context, installDir string) (string, error) {
+	output, err := hl.invokeBinScript(ctx, "post-activate", installDir)
 
 	// providing a post-activate script is optional, ignore those errors
 	if err != nil && !os.IsNotExist(err) {
@@ -88,8 +119,8 @@ func (hl *Launchable) PostActivate() (string, error) {
 	return output, nil
 }
 
-func (hl *Launchable) Disable() (string, error) {
-	output, err := hl.invokeBinScript("disable")
+func (hl *Launchable) Disable(ctx context.Context, installDir string) (string, error) {
+	output, err := hl.invokeBinScript(ctx, "disable", installDir)
 
 	// providing a disable script is optional, ignore those errors
 	if err != nil && !os.IsNotExist(err) {
@@ -99,8 +130,8 @@ func (hl *Launchable) Disable() (string, error) {
 	return output, nil
 }
 
-func (hl *Launchable) Enable() (string, error) {
-	output, err := hl.invokeBinScript("enable")
+func (hl *Launchable) Enable(ctx context.Context, installDir string) (string, error) {
+	output, err := hl.invokeBinScript(ctx, "enable", installDir)
 
 	// providing an enable script is optional, ignore those errors
 	if err != nil && !os.IsNotExist(err) {
@@ -110,14 +141,20 @@ func (hl *Launchable) Enable() (string, error) {
 	return output, nil
 }
 
-func (hl *Launchable) invokeBinScript(script string) (string, error) {
-	cmdPath := filepath.Join(hl.InstallDir(), "bin", script)
+func (hl *Launchable) invokeBinScript(ctx context.Context, script string, installDir string) (string, error) {
+	cmdPath := filepath.Join(installDir, "bin", script)
 	_, err := os.Stat(cmdPath)
 	if err != nil {
 		return "", err
 	}
 
-	cmd := exec.Command(hl.Chpst, "-u", hl.RunAs, "-e", hl.ConfigDir, cmdPath)
+	if hl.HookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hl.HookTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, hl.Chpst, "-u", hl.RunAs, "-e", hl.ConfigDir, cmdPath)
 	buffer := bytes.Buffer{}
 	cmd.Stdout = &buffer
 	cmd.Stderr = &buffer
@@ -129,13 +166,17 @@ func (hl *Launchable) invokeBinScript(script string) (string, error) {
 	return buffer.String(), nil
 }
 
-func (hl *Launchable) Stop(serviceBuilder *runit.ServiceBuilder, sv *runit.SV) error {
-	executables, err := hl.Executables(serviceBuilder)
+func (hl *Launchable) Stop(ctx context.Context, serviceBuilder *runit.ServiceBuilder, sv *runit.SV, installDir string) error {
+	executables, err := hl.Executables(serviceBuilder, installDir)
 	if err != nil {
 		return err
 	}
 
 	for _, executable := range executables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// if we use sv -w to wait for the service to stop and then SIGKILL, we
 		// will also kill the preparer itself before it can restart. do not use
 		// sv -w yet.
@@ -152,14 +193,18 @@ func (hl *Launchable) Stop(serviceBuilder *runit.ServiceBuilder, sv *runit.SV) e
 
 // Start will take a launchable and start every runit service associated with the launchable.
 // All services will attempt to be started.
-func (hl *Launchable) Start(serviceBuilder *runit.ServiceBuilder, sv *runit.SV) error {
+func (hl *Launchable) Start(ctx context.Context, serviceBuilder *runit.ServiceBuilder, sv *runit.SV, installDir string) error {
 
-	executables, err := hl.Executables(serviceBuilder)
+	executables, err := hl.Executables(serviceBuilder, installDir)
 	if err != nil {
 		return err
 	}
 
 	for _, executable := range executables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		_, err := sv.Restart(&executable.Service)
 		if err != runit.SuperviseOkMissing {
 			return err
@@ -169,12 +214,12 @@ func (hl *Launchable) Start(serviceBuilder *runit.ServiceBuilder, sv *runit.SV)
 	return nil
 }
 
-func (hl *Launchable) Executables(serviceBuilder *runit.ServiceBuilder) ([]Executable, error) {
-	if !hl.Installed() {
-		return []Executable{}, util.Errorf("%s is not installed", hl.Id)
+func (hl *Launchable) Executables(serviceBuilder *runit.ServiceBuilder, installDir string) ([]Executable, error) {
+	if _, err := os.Stat(installDir); err != nil {
+		return []Executable{}, util.Errorf("%s is not installed at %s", hl.Id, installDir)
 	}
 
-	binLaunchPath := filepath.Join(hl.InstallDir(), "bin", "launch")
+	binLaunchPath := filepath.Join(installDir, "bin", "launch")
 
 	binLaunchInfo, err := os.Stat(binLaunchPath)
 	if err != nil {
@@ -219,12 +264,18 @@ func (hl *Launchable) Installed() bool {
 	return err == nil
 }
 
-func (hl *Launchable) Install() error {
+func (hl *Launchable) Install(ctx context.Context) error {
 	if hl.Installed() {
 		// install is idempotent, no-op if already installed
 		return nil
 	}
 
+	if hl.InstallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hl.InstallTimeout)
+		defer cancel()
+	}
+
 	outDir, err := ioutil.TempDir("", hl.Version())
 	defer os.RemoveAll(outDir)
 	if err != nil {
@@ -233,29 +284,59 @@ func (hl *Launchable) Install() error {
 
 	outPath := filepath.Join(outDir, hl.Version())
 
-	err = hl.FetchToFile(hl.Location, outPath)
+	err = hl.FetchToFile(ctx, hl.Location, outPath)
 	if err != nil {
 		return err
 	}
 
+	err = hl.verifyArtifact(ctx, outPath)
+	if err != nil {
+		os.Remove(outPath)
+		return err
+	}
+
 	fd, err := os.Open(outPath)
 	if err != nil {
 		return err
 	}
 	defer fd.Close()
 
-	err = hl.extractTarGz(fd, hl.InstallDir())
+	err = hl.extractArchive(ctx, fd, hl.InstallDir())
 	if err != nil {
 		return err
 	}
+
+	if hl.Retention != nil {
+		// Install doesn't call MakeCurrent itself, so at this point the
+		// install we just extracted isn't yet referenced by current or
+		// last; it's only protected from Prune by being the newest entry
+		// in the candidate sort. A policy that can select the newest
+		// install anyway (KeepLastN(0), a very small KeepSince) can prune
+		// what Install just installed before the caller ever points at it.
+		_, err = hl.Prune(hl.Retention)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// archiveSuffixes lists the artifact filename extensions this package knows
+// how to extract. Version strips the first one that matches; other names are
+// returned unchanged.
+var archiveSuffixes = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".zip"}
+
 // The version of the artifact is currently derived from the location, using
-// the naming scheme <the-app>_<unique-version-string>.tar.gz
+// the naming scheme <the-app>_<unique-version-string><archive-suffix>
 func (hl *Launchable) Version() string {
 	fileName := filepath.Base(hl.Location)
-	return fileName[:len(fileName)-len(".tar.gz")]
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(fileName, suffix) {
+			return fileName[:len(fileName)-len(suffix)]
+		}
+	}
+	return fileName
 }
 
 func (*Launchable) Type() string {
@@ -293,13 +374,17 @@ func (hl *Launchable) MakeLast() error {
 }
 
 func (hl *Launchable) flipSymlink(newLinkPath string) error {
+	return hl.flipSymlinkTo(newLinkPath, hl.InstallDir())
+}
+
+func (hl *Launchable) flipSymlinkTo(newLinkPath string, target string) error {
 	dir, err := ioutil.TempDir(hl.RootDir, hl.Id)
 	if err != nil {
 		return util.Errorf("Couldn't create temporary directory for symlink: %s", err)
 	}
 	defer os.RemoveAll(dir)
 	tempLinkPath := filepath.Join(dir, hl.Id)
-	err = os.Symlink(hl.InstallDir(), tempLinkPath)
+	err = os.Symlink(target, tempLinkPath)
 	if err != nil {
 		return util.Errorf("Couldn't create symlink for hoist launchable %s: %s", hl.Id, err)
 	}
@@ -316,19 +401,73 @@ func (hl *Launchable) flipSymlink(newLinkPath string) error {
 	return os.Rename(tempLinkPath, newLinkPath)
 }
 
+// Rollback restores whatever install the last symlink points to, on the
+// assumption that it is known-good (the same assumption MakeLast's callers,
+// such as Halt, already rely on). It disables and stops the currently
+// running install, swaps current and last, then starts and enables the
+// restored one, giving preparers a way to undo a bad push without
+// re-downloading the prior artifact.
+func (hl *Launchable) Rollback(ctx context.Context, serviceBuilder *runit.ServiceBuilder, sv *runit.SV) error {
+	currentTarget, err := filepath.EvalSymlinks(hl.CurrentDir())
+	if err != nil {
+		return util.Errorf("Couldn't resolve %s for hoist launchable %s: %s", hl.CurrentDir(), hl.Id, err)
+	}
+
+	lastTarget, err := filepath.EvalSymlinks(hl.LastDir())
+	if err != nil {
+		return util.Errorf("Couldn't resolve %s for hoist launchable %s: %s", hl.LastDir(), hl.Id, err)
+	}
+
+	if lastTarget == currentTarget {
+		return util.Errorf("%s has no last install to roll back to", hl.Id)
+	}
+
+	if _, err := os.Stat(lastTarget); err != nil {
+		return util.Errorf("Last install %s for hoist launchable %s is no longer on disk: %s", lastTarget, hl.Id, err)
+	}
+
+	_, err = hl.Disable(ctx, currentTarget)
+	if err != nil {
+		return err
+	}
+
+	err = hl.Stop(ctx, serviceBuilder, sv, currentTarget)
+	if err != nil {
+		return err
+	}
+
+	// Flip current to the restored target first: if this succeeds but the
+	// second flip below fails, current still correctly points at the good
+	// install. Flipping last first would instead leave both symlinks
+	// pointing at the bad (already disabled and stopped) install on a
+	// mid-operation failure.
+	err = hl.flipSymlinkTo(hl.CurrentDir(), lastTarget)
+	if err != nil {
+		return err
+	}
+
+	err = hl.flipSymlinkTo(hl.LastDir(), currentTarget)
+	if err != nil {
+		return err
+	}
+
+	err = hl.Start(ctx, serviceBuilder, sv, lastTarget)
+	if err != nil {
+		return err
+	}
+
+	_, err = hl.Enable(ctx, lastTarget)
+	return err
+}
+
 func (hl *Launchable) InstallDir() string {
 	launchableName := hl.Version()
 	return filepath.Join(hl.RootDir, "installs", launchableName)
 }
 
-func (hl *Launchable) extractTarGz(fp *os.File, dest string) (err error) {
-	fz, err := gzip.NewReader(fp)
-	if err != nil {
-		return util.Errorf("Unable to create gzip reader: %s", err)
-	}
-	defer fz.Close()
-
-	tr := tar.NewReader(fz)
+// extractArchive sniffs fp's format and unpacks it to dest using the
+// matching Extractor. See archive.go.
+func (hl *Launchable) extractArchive(ctx context.Context, fp *os.File, dest string) error {
 	uid, gid, err := user.IDs(hl.RunAs)
 	if err != nil {
 		return err
@@ -343,65 +482,15 @@ func (hl *Launchable) extractTarGz(fp *os.File, dest string) (err error) {
 		return util.Errorf("Unable to chown root directory %s to %s when unpacking %s: %s", dest, hl.RunAs, fp.Name(), err)
 	}
 
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return util.Errorf("Unable to read %s: %s", fp.Name(), err)
-		}
-		fpath := filepath.Join(dest, hdr.Name)
-
-		switch hdr.Typeflag {
-		case tar.TypeSymlink:
-			err = os.Symlink(hdr.Linkname, fpath)
-			if err != nil {
-				return util.Errorf("Unable to create destination symlink %s (to %s) when unpacking %s: %s", fpath, hdr.Linkname, fp.Name(), err)
-			}
-		case tar.TypeLink:
-			// hardlink paths are encoded relative to the tarball root, rather than
-			// the path of the link itself, so we need to resolve that path
-			linkTarget, err := filepath.Rel(filepath.Dir(hdr.Name), hdr.Linkname)
-			if err != nil {
-				return util.Errorf("Unable to resolve relative path for hardlink %s (to %s) when unpacking %s: %s", fpath, hdr.Linkname, fp.Name(), err)
-			}
-			// we can't make the hardlink right away because the target might not
-			// exist, so we'll just make a symlink instead
-			err = os.Symlink(linkTarget, fpath)
-			if err != nil {
-				return util.Errorf("Unable to create destination symlink %s (resolved %s to %s) when unpacking %s: %s", fpath, linkTarget, hdr.Linkname, fp.Name(), err)
-			}
-		case tar.TypeDir:
-			err = os.Mkdir(fpath, hdr.FileInfo().Mode())
-			if err != nil && !os.IsExist(err) {
-				return util.Errorf("Unable to create destination directory %s when unpacking %s: %s", fpath, fp.Name(), err)
-			}
-
-			err = os.Chown(fpath, uid, gid)
-			if err != nil {
-				return util.Errorf("Unable to chown destination directory %s to %s when unpacking %s: %s", fpath, hl.RunAs, fp.Name(), err)
-			}
-		case tar.TypeReg, tar.TypeRegA:
-			f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode())
-			if err != nil {
-				return util.Errorf("Unable to open destination file %s when unpacking %s: %s", fpath, fp.Name(), err)
-			}
-			defer f.Close()
-
-			err = f.Chown(uid, gid) // this operation may cause tar unpacking to become significantly slower. Refactor as necessary.
-			if err != nil {
-				return util.Errorf("Unable to chown destination file %s to %s when unpacking %s: %s", fpath, hl.RunAs, fp.Name(), err)
-			}
-
-			_, err = io.Copy(f, tr)
-			if err != nil {
-				return util.Errorf("Unable to copy into destination file %s when unpacking %s: %s", fpath, fp.Name(), err)
-			}
-			f.Close() // eagerly release file descriptors rather than letting them pile up
-		default:
-			return util.Errorf("Unhandled type flag %q (header %v) when unpacking %s", hdr.Typeflag, hdr, fp.Name())
-		}
+	extractor, err := extractorFor(fp)
+	if err != nil {
+		return util.Errorf("Unable to determine archive format of %s: %s", fp.Name(), err)
 	}
+
+	err = extractor.Extract(ctx, fp, dest, uid, gid)
+	if err != nil {
+		return util.Errorf("Unable to unpack %s: %s", fp.Name(), err)
+	}
+
 	return nil
 }
@@ -0,0 +1,98 @@
+package hoist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// RetentionPolicy decides which old installs a Launchable no longer needs.
+// Prune always excludes whatever the current and last symlinks point to
+// before a policy ever sees the candidate list, so a policy only has to
+// reason about everything else.
+type RetentionPolicy interface {
+	// SelectForRemoval receives the installs under RootDir/installs that
+	// aren't pointed at by current or last, sorted oldest-first by mtime,
+	// and returns the subset that should be deleted.
+	SelectForRemoval(candidates []os.FileInfo) []os.FileInfo
+}
+
+// KeepLastN retains only the N most recently modified non-referenced
+// installs and removes the rest.
+type KeepLastN int
+
+func (n KeepLastN) SelectForRemoval(candidates []os.FileInfo) []os.FileInfo {
+	if len(candidates) <= int(n) {
+		return nil
+	}
+	return candidates[:len(candidates)-int(n)]
+}
+
+// KeepSince retains non-referenced installs modified within the last d and
+// removes anything older.
+type KeepSince time.Duration
+
+func (d KeepSince) SelectForRemoval(candidates []os.FileInfo) []os.FileInfo {
+	cutoff := time.Now().Add(-time.Duration(d))
+
+	var remove []os.FileInfo
+	for _, candidate := range candidates {
+		if candidate.ModTime().Before(cutoff) {
+			remove = append(remove, candidate)
+		}
+	}
+	return remove
+}
+
+// Prune removes old installs according to policy, always retaining whatever
+// the current and last symlinks point to. It returns the versions that were
+// removed.
+func (hl *Launchable) Prune(policy RetentionPolicy) ([]string, error) {
+	installsDir := filepath.Join(hl.RootDir, "installs")
+	entries, err := ioutil.ReadDir(installsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, util.Errorf("Unable to list installs for %s: %s", hl.Id, err)
+	}
+
+	referenced := map[string]bool{}
+	for _, linkPath := range []string{hl.CurrentDir(), hl.LastDir()} {
+		target, err := filepath.EvalSymlinks(linkPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, util.Errorf("Unable to resolve %s for %s: %s", linkPath, hl.Id, err)
+		}
+		referenced[filepath.Base(target)] = true
+	}
+
+	var candidates []os.FileInfo
+	for _, entry := range entries {
+		if referenced[entry.Name()] {
+			continue
+		}
+		candidates = append(candidates, entry)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ModTime().Before(candidates[j].ModTime())
+	})
+
+	var removed []string
+	for _, loser := range policy.SelectForRemoval(candidates) {
+		err := os.RemoveAll(filepath.Join(installsDir, loser.Name()))
+		if err != nil {
+			return removed, util.Errorf("Unable to remove old install %s for %s: %s", loser.Name(), hl.Id, err)
+		}
+		removed = append(removed, loser.Name())
+	}
+
+	return removed, nil
+}
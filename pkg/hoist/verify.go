@@ -0,0 +1,93 @@
+package hoist
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// ErrChecksumMismatch is returned by Install when a downloaded artifact's
+// SHA256 does not match Launchable.ExpectedSHA256.
+var ErrChecksumMismatch = errors.New("artifact checksum does not match expected value")
+
+// ErrBadSignature is returned by Install when a downloaded artifact's
+// detached signature does not verify against Launchable.Keyring.
+var ErrBadSignature = errors.New("artifact signature did not verify against the configured keyring")
+
+// verifyArtifact checks the file downloaded to artifactPath against
+// hl.ExpectedSHA256 and, if hl.SignatureLocation is set, against a detached
+// signature fetched from that location. It must be called before the
+// artifact is ever extracted.
+func (hl *Launchable) verifyArtifact(ctx context.Context, artifactPath string) error {
+	if hl.ExpectedSHA256 != "" {
+		err := hl.verifyChecksum(artifactPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hl.SignatureLocation != "" {
+		err := hl.verifySignature(ctx, artifactPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (hl *Launchable) verifyChecksum(artifactPath string) error {
+	f, err := os.Open(artifactPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return util.Errorf("Unable to hash %s: %s", artifactPath, err)
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != hl.ExpectedSHA256 {
+		return util.Errorf("%w: %s (expected %s, got %s)", ErrChecksumMismatch, artifactPath, hl.ExpectedSHA256, digest)
+	}
+
+	return nil
+}
+
+func (hl *Launchable) verifySignature(ctx context.Context, artifactPath string) error {
+	sigPath := artifactPath + ".asc"
+	err := hl.FetchToFile(ctx, hl.SignatureLocation, sigPath)
+	if err != nil {
+		return util.Errorf("Unable to fetch signature %s: %s", hl.SignatureLocation, err)
+	}
+	defer os.Remove(sigPath)
+
+	artifactFile, err := os.Open(artifactPath)
+	if err != nil {
+		return err
+	}
+	defer artifactFile.Close()
+
+	sigFile, err := os.Open(sigPath)
+	if err != nil {
+		return err
+	}
+	defer sigFile.Close()
+
+	_, err = openpgp.CheckDetachedSignature(hl.Keyring, artifactFile, sigFile)
+	if err != nil {
+		return util.Errorf("%w: %s: %s", ErrBadSignature, artifactPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package hoist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerifyChecksumMismatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "verify-checksum")
+	if err != nil {
+		t.Fatalf("creating temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString("hello world"); err != nil {
+		t.Fatalf("writing temp file: %s", err)
+	}
+	f.Close()
+
+	hl := &Launchable{ExpectedSHA256: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeef"}
+	err = hl.verifyChecksum(f.Name())
+	if err == nil {
+		t.Fatalf("expected an error, got nil")
+	}
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected errors.Is(err, ErrChecksumMismatch), got %s", err)
+	}
+}
+
+func TestVerifyChecksumMatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "verify-checksum")
+	if err != nil {
+		t.Fatalf("creating temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	content := "hello world"
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("writing temp file: %s", err)
+	}
+	f.Close()
+
+	digest := sha256.Sum256([]byte(content))
+	hl := &Launchable{ExpectedSHA256: hex.EncodeToString(digest[:])}
+	if err := hl.verifyChecksum(f.Name()); err != nil {
+		t.Fatalf("expected nil error, got %s", err)
+	}
+}
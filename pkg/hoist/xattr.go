@@ -0,0 +1,27 @@
+package hoist
+
+import (
+	"archive/tar"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// applyXattrs restores the extended attributes recorded in hdr.Xattrs (tar
+// PAX records) onto the file at path. Only security.capability and user.*
+// xattrs are restored; everything else is the tar format's own bookkeeping
+// and isn't meaningful to replay onto the filesystem.
+func applyXattrs(path string, hdr *tar.Header) error {
+	for name, value := range hdr.Xattrs {
+		if name != "security.capability" && !strings.HasPrefix(name, "user.") {
+			continue
+		}
+
+		err := unix.Setxattr(path, name, []byte(value), 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}